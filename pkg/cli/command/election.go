@@ -15,10 +15,23 @@
 package command
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/atomix/go-client/pkg/client/election"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 func newElectionCommand() *cobra.Command {
@@ -48,31 +61,51 @@ func newElectionCommand() *cobra.Command {
 			var subCmd *cobra.Command
 			op := args[1]
 			switch op {
+			case "anoint":
+				subCmd = newElectionAnointCommand(name)
 			case "enter":
 				subCmd = newElectionEnterCommand(name)
+			case "evict":
+				subCmd = newElectionEvictCommand(name)
 			case "get":
 				subCmd = newElectionGetCommand(name)
+			case "promote":
+				subCmd = newElectionPromoteCommand(name)
 			case "watch":
 				subCmd = newElectionWatchCommand(name)
+			case "webhook":
+				subCmd = newElectionWebhookCommand(name)
 			case "help", "-h", "--help":
 				if len(args) == 2 {
 					helpCmd := &cobra.Command{
 						Use:   fmt.Sprintf("election %s [...]", name),
 						Short: "Manage the state of a distributed leader election",
 					}
+					helpCmd.AddCommand(newElectionAnointCommand(name))
 					helpCmd.AddCommand(newElectionEnterCommand(name))
+					helpCmd.AddCommand(newElectionEvictCommand(name))
 					helpCmd.AddCommand(newElectionGetCommand(name))
+					helpCmd.AddCommand(newElectionPromoteCommand(name))
 					helpCmd.AddCommand(newElectionWatchCommand(name))
+					helpCmd.AddCommand(newElectionWebhookCommand(name))
 					return helpCmd.Help()
 				} else {
 					var helpCmd *cobra.Command
 					switch args[2] {
+					case "anoint":
+						helpCmd = newElectionAnointCommand(name)
 					case "enter":
 						helpCmd = newElectionEnterCommand(name)
+					case "evict":
+						helpCmd = newElectionEvictCommand(name)
 					case "get":
 						helpCmd = newElectionGetCommand(name)
+					case "promote":
+						helpCmd = newElectionPromoteCommand(name)
 					case "watch":
 						helpCmd = newElectionWatchCommand(name)
+					case "webhook":
+						helpCmd = newElectionWebhookCommand(name)
 					default:
 						return fmt.Errorf("unknown command %s", args[2])
 					}
@@ -146,11 +179,11 @@ func newElectionGetTermCommand(name string) *cobra.Command {
 			if err != nil {
 				return err
 			} else if term != nil {
-				bytes, err := yaml.Marshal(term)
+				out, err := yaml.Marshal(term)
 				if err != nil {
 					return err
 				}
-				cmd.Println(string(bytes))
+				cmd.Println(string(out))
 			}
 			return nil
 		},
@@ -158,48 +191,275 @@ func newElectionGetTermCommand(name string) *cobra.Command {
 	return cmd
 }
 
+func newElectionAnointCommand(name string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "anoint {<id>,--random}",
+		Long: `Assign leadership to a candidate.
+
+With --random, if the election has no leader a randomly chosen current candidate is anointed.
+Random selection is an advisory client-side policy: the term may change between reading the
+candidates and anointing one, and other clients may choose differently.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			random, _ := cmd.Flags().GetBool("random")
+			if random && len(args) > 0 {
+				return fmt.Errorf("cannot specify a candidate with --random")
+			} else if !random && len(args) == 0 {
+				return fmt.Errorf("a candidate or --random must be specified")
+			}
+
+			e, err := getElection(cmd, name, "")
+			if err != nil {
+				return err
+			}
+			ctx, cancel := getTimeoutContext(cmd)
+			defer cancel()
+
+			var term *election.Term
+			if random {
+				seed, _ := cmd.Flags().GetInt64("seed")
+				if !cmd.Flags().Changed("seed") {
+					seed = time.Now().UnixNano()
+				}
+				term, err = anointRandomCandidate(ctx, e, rand.New(rand.NewSource(seed)))
+			} else {
+				term, err = e.Anoint(ctx, args[0])
+			}
+			if err != nil {
+				return err
+			} else if term != nil {
+				out, err := yaml.Marshal(term)
+				if err != nil {
+					return err
+				}
+				cmd.Println(string(out))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("random", false, "anoint a random candidate if the election has no leader")
+	cmd.Flags().Int64("seed", 0, "the seed used to choose a random candidate (default: the current time)")
+	return cmd
+}
+
+// anointRandomCandidate anoints a candidate chosen using the given source of randomness if the
+// election has no leader. If the election already has a leader, the current term is returned.
+func anointRandomCandidate(ctx context.Context, e election.Election, rnd *rand.Rand) (*election.Term, error) {
+	term, err := e.GetTerm(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if term != nil && term.Leader != "" {
+		return term, nil
+	}
+	if term == nil || len(term.Candidates) == 0 {
+		return nil, fmt.Errorf("election has no candidates")
+	}
+	return e.Anoint(ctx, term.Candidates[rnd.Intn(len(term.Candidates))])
+}
+
+func newElectionEvictCommand(name string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "evict <id>",
+		Long: `Remove a candidate from the election.
+
+If the evicted candidate is the leader, leadership passes to the next candidate in the queue.
+To migrate a leader to a new candidate id without a leadership gap, enter the new id, anoint it,
+and then evict the old id. The enter command keeps running for as long as the new candidate
+participates in the election, so run it from the process that will own the new id:
+
+  atomix election <name> enter <new-id>
+  atomix election <name> anoint <new-id>
+  atomix election <name> evict <old-id>`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e, err := getElection(cmd, name, "")
+			if err != nil {
+				return err
+			}
+			ctx, cancel := getTimeoutContext(cmd)
+			defer cancel()
+			term, err := e.Evict(ctx, args[0])
+			if err != nil {
+				return err
+			} else if term != nil {
+				out, err := yaml.Marshal(term)
+				if err != nil {
+					return err
+				}
+				cmd.Println(string(out))
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newElectionPromoteCommand(name string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:  "promote <id> [<id>...]",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e, err := getElection(cmd, name, "")
+			if err != nil {
+				return err
+			}
+			ctx, cancel := getTimeoutContext(cmd)
+			defer cancel()
+			term, err := promoteCandidates(ctx, e, args)
+			if term != nil {
+				out, marshalErr := yaml.Marshal(term)
+				if marshalErr != nil {
+					cmd.Println(marshalErr)
+				} else {
+					cmd.Println(string(out))
+				}
+			}
+			return err
+		},
+	}
+	return cmd
+}
+
+// promoteCandidates promotes each of the given candidates in order and returns the resulting term.
+// If a promotion fails, the term reached by the preceding promotions is returned along with the error.
+func promoteCandidates(ctx context.Context, e election.Election, ids []string) (*election.Term, error) {
+	var term *election.Term
+	for _, id := range ids {
+		t, err := e.Promote(ctx, id)
+		if err != nil {
+			return term, fmt.Errorf("failed to promote %s: %w", id, err)
+		}
+		term = t
+	}
+	return term, nil
+}
+
 func newElectionEnterCommand(name string) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:  "enter <id>",
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			// Register for signals before entering the election so a shutdown signal cannot be missed
+			sigCh := make(chan os.Signal, 2)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigCh)
+
 			watchCh := make(chan *election.Event)
-			election, err := getElection(cmd, name, args[0])
+			e, err := getElection(cmd, name, args[0])
 			if err != nil {
 				return err
 			}
 
 			// Create a watch on the election
-			watchCtx, watchCancel := getCancelContext(cmd)
+			// The watch is not tied to signals so events can still be received while leaving the election
+			watchCtx, watchCancel := context.WithCancel(context.Background())
 			defer watchCancel()
-			err = election.Watch(watchCtx, watchCh)
+			err = e.Watch(watchCtx, watchCh)
 			if err != nil {
 				return err
 			}
 
 			// Enter the election
-			ctx, cancel := getTimeoutContext(cmd)
-			_, err = election.Enter(ctx)
+			// The enter is not cancelled by signals so a signal received while entering still leaves the election
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			_, err = e.Enter(ctx)
 			cancel()
 			if err != nil {
 				return err
 			}
 
-			// Once we've successfully entered the election, wait for watch events
-			for event := range watchCh {
-				bytes, err := yaml.Marshal(event)
-				if err != nil {
-					cmd.Println(err)
-				} else {
-					cmd.Println(string(bytes))
+			// Once we've successfully entered the election, wait for watch events until interrupted
+			for {
+				select {
+				case event, ok := <-watchCh:
+					if !ok {
+						return nil
+					}
+					printElectionEvent(cmd, event)
+				case <-sigCh:
+					shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+					return leaveElection(cmd, e, watchCh, sigCh, shutdownTimeout)
 				}
 			}
-			return nil
 		},
 	}
+	cmd.Flags().Duration("shutdown-timeout", 15*time.Second, "the maximum time to leave the election and wait for a new leader on shutdown")
 	return cmd
 }
 
+// leaveElection withdraws from the election and, if other candidates remain, waits up to the timeout
+// for one of them to be reported as leader before closing the election. Waiting for a new leader is
+// best-effort: once the candidate has left the election it is closed even if no new leader was observed.
+// An error is returned if the candidate cannot leave the election within the timeout or if another
+// signal is received while leaving.
+func leaveElection(cmd *cobra.Command, e election.Election, watchCh <-chan *election.Event, sigCh <-chan os.Signal, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Abort the shutdown if another signal is received to allow the user to force the command to exit
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	term, err := e.Leave(ctx)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return fmt.Errorf("shutdown interrupted before leaving the election")
+		}
+		return fmt.Errorf("failed to leave the election within %s: %w", timeout, err)
+	}
+
+wait:
+	for awaitingLeader(e.ID(), term) {
+		select {
+		case event, ok := <-watchCh:
+			if !ok {
+				cmd.Println("Election watch closed before a new leader was elected")
+				break wait
+			}
+			printElectionEvent(cmd, event)
+			term = &event.Term
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return fmt.Errorf("shutdown interrupted before a new leader was elected")
+			}
+			cmd.Printf("No new leader within %s\n", timeout)
+			break wait
+		}
+	}
+
+	closeCtx, closeCancel := getTimeoutContext(cmd)
+	defer closeCancel()
+	return e.Close(closeCtx)
+}
+
+// awaitingLeader returns whether the given term is still led by the candidate with the given ID or
+// is awaiting a leader from the remaining candidates
+func awaitingLeader(id string, term *election.Term) bool {
+	if term == nil {
+		return false
+	}
+	if term.Leader == id {
+		return true
+	}
+	return term.Leader == "" && len(term.Candidates) > 0
+}
+
+func printElectionEvent(cmd *cobra.Command, event *election.Event) {
+	out, err := yaml.Marshal(event)
+	if err != nil {
+		cmd.Println(err)
+	} else {
+		cmd.Println(string(out))
+	}
+}
+
 func newElectionWatchCommand(name string) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:  "watch",
@@ -218,15 +478,199 @@ func newElectionWatchCommand(name string) *cobra.Command {
 			}
 
 			for event := range watchCh {
-				bytes, err := yaml.Marshal(event)
-				if err != nil {
-					cmd.Println(err)
-				} else {
-					cmd.Println(string(bytes))
+				printElectionEvent(cmd, event)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newElectionWebhookCommand(name string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:  "webhook <url>",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			e, err := getElection(cmd, name, "")
+			if err != nil {
+				return err
+			}
+
+			secret, _ := cmd.Flags().GetString("secret")
+			retries, _ := cmd.Flags().GetInt("retries")
+			if retries < 0 {
+				return fmt.Errorf("retries must not be negative")
+			}
+			backoff, _ := cmd.Flags().GetDuration("retry-backoff")
+			if backoff <= 0 {
+				return fmt.Errorf("retry-backoff must be positive")
+			}
+			queueSize, _ := cmd.Flags().GetInt("queue-size")
+			if queueSize < 1 {
+				return fmt.Errorf("queue-size must be at least 1")
+			}
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			webhook := &electionWebhook{
+				url:     args[0],
+				secret:  []byte(secret),
+				retries: retries,
+				backoff: backoff,
+				client:  &http.Client{Timeout: timeout},
+			}
+
+			watchCh := make(chan *election.Event)
+			ctx, cancel := getCancelContext(cmd)
+			defer cancel()
+			if err := e.Watch(ctx, watchCh); err != nil {
+				return err
+			}
+
+			// Get the current term to avoid dispatching a change for the existing leader
+			termCtx, termCancel := getTimeoutContext(cmd)
+			term, err := e.GetTerm(termCtx)
+			termCancel()
+			if err != nil {
+				return err
+			}
+			var leader string
+			if term != nil {
+				leader = term.Leader
+			}
+
+			// Deliver leader changes in order in the background so a slow webhook does not block the watch.
+			// Changes are queued while a delivery is being retried. If the queue is full, new changes are
+			// dropped and counted as dead letters.
+			pendingCh := make(chan election.Term, queueSize)
+			doneCh := make(chan struct{})
+			go func() {
+				defer close(doneCh)
+				for term := range pendingCh {
+					if ctx.Err() != nil {
+						continue
+					}
+					if err := webhook.dispatch(ctx, name, term); err != nil && ctx.Err() == nil {
+						cmd.Printf("Failed to deliver term %d: %s (%d dead letters)\n", term.ID, err, webhook.getDeadLetters())
+					}
+				}
+			}()
+
+			for event := range watchCh {
+				if event.Term.Leader == leader {
+					continue
+				}
+				leader = event.Term.Leader
+
+				select {
+				case pendingCh <- event.Term:
+				default:
+					cmd.Printf("Dropped term %d: delivery queue is full (%d dead letters)\n", event.Term.ID, webhook.addDeadLetter())
 				}
 			}
+			close(pendingCh)
+			<-doneCh
 			return nil
 		},
 	}
+	cmd.Flags().String("secret", "", "the secret with which to sign payloads using HMAC-SHA256")
+	cmd.Flags().Int("retries", 5, "the maximum number of times to retry a failed delivery")
+	cmd.Flags().Int("queue-size", 64, "the maximum number of leader changes to queue while a delivery is in progress")
+	cmd.Flags().Duration("retry-backoff", time.Second, fmt.Sprintf("the initial delay between delivery retries, doubled after each retry up to %s", maxElectionWebhookBackoff))
 	return cmd
 }
+
+// maxElectionWebhookBackoff is the maximum delay between webhook delivery retries
+const maxElectionWebhookBackoff = time.Minute
+
+// electionWebhookSignatureHeader is the header containing the HMAC-SHA256 signature of the payload
+const electionWebhookSignatureHeader = "X-Atomix-Signature"
+
+// electionWebhookPayload is the JSON payload posted to the webhook on leader changes
+type electionWebhookPayload struct {
+	Election   string   `json:"election"`
+	Term       uint64   `json:"term"`
+	Leader     string   `json:"leader"`
+	Candidates []string `json:"candidates"`
+}
+
+// electionWebhook posts election leader changes to a URL
+type electionWebhook struct {
+	url         string
+	secret      []byte
+	retries     int
+	backoff     time.Duration
+	client      *http.Client
+	deadLetters int64
+}
+
+// addDeadLetter counts an undelivered term and returns the number of dead letters
+func (w *electionWebhook) addDeadLetter() int64 {
+	return atomic.AddInt64(&w.deadLetters, 1)
+}
+
+// getDeadLetters returns the number of terms that could not be delivered
+func (w *electionWebhook) getDeadLetters() int64 {
+	return atomic.LoadInt64(&w.deadLetters)
+}
+
+// dispatch posts the given term to the webhook, retrying failed deliveries with exponential backoff.
+// If the term cannot be delivered after all retries, it's counted as a dead letter. Deliveries
+// abandoned because the context was cancelled are not counted as dead letters.
+func (w *electionWebhook) dispatch(ctx context.Context, name string, term election.Term) error {
+	body, err := json.Marshal(&electionWebhookPayload{
+		Election:   name,
+		Term:       term.ID,
+		Leader:     term.Leader,
+		Candidates: term.Candidates,
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == w.retries {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+			if backoff > maxElectionWebhookBackoff {
+				backoff = maxElectionWebhookBackoff
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.addDeadLetter()
+	return err
+}
+
+func (w *electionWebhook) post(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		request.Header.Set(electionWebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
@@ -15,7 +15,10 @@
 package command
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/atomix/go-client/pkg/client"
 	"github.com/atomix/go-client/pkg/client/counter"
 	"github.com/atomix/go-client/pkg/client/election"
 	"github.com/atomix/go-client/pkg/client/indexedmap"
@@ -30,6 +33,9 @@ import (
 	"github.com/iancoleman/strcase"
 	"github.com/spf13/cobra"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"text/tabwriter"
 )
 
@@ -61,11 +67,20 @@ func newGetElectionsCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "elections [args]",
 		Short: "List elections in a database",
+		Long: `List elections in a database.
+
+With --leaders the current term of each election is read to include its leader and candidate count.
+Reading an election opens it, so an election deleted while the list is being read is created again.
+Each read has its own --timeout. Elections that cannot be read are listed with their error, and the
+command fails once all elections have been listed.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return getPrimitives(cmd, election.Type)
+			return getElections(cmd)
 		},
 	}
 	cmd.Flags().Bool("no-headers", false, "exclude headers from output")
+	cmd.Flags().Bool("leaders", false, "include the leader and candidate count of each election")
+	cmd.Flags().Int("concurrency", 8, "the maximum number of elections to read concurrently with --leaders")
+	cmd.Flags().StringP("output", "o", "table", "the output format (table or json)")
 	return cmd
 }
 
@@ -187,14 +202,160 @@ func getPrimitives(cmd *cobra.Command, primitiveType primitive.Type) error {
 	return printPrimitives(primitives, !noHeaders, cmd.OutOrStdout())
 }
 
+// electionInfo is the listing of an election
+// The leader and candidate count are only set once the election's term has been read.
+type electionInfo struct {
+	Name       string  `json:"name"`
+	Scope      string  `json:"scope"`
+	Leader     *string `json:"leader,omitempty"`
+	Candidates *int    `json:"candidates,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func getElections(cmd *cobra.Command) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %s", output)
+	}
+	leaders, _ := cmd.Flags().GetBool("leaders")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	database, err := getDatabase(cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := getTimeoutContext(cmd)
+	primitives, err := database.GetPrimitives(ctx, primitive.WithPrimitiveType(election.Type))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	elections := make([]electionInfo, len(primitives))
+	for i, p := range primitives {
+		elections[i] = electionInfo{
+			Name:  p.Name.Name,
+			Scope: p.Name.Scope,
+		}
+	}
+
+	failed := 0
+	if leaders {
+		failed = readElectionTerms(cmd, database, elections, concurrency)
+	}
+
+	noHeaders, _ := cmd.Flags().GetBool("no-headers")
+	if output == "json" {
+		out, err := json.MarshalIndent(elections, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), string(out))
+	} else if leaders {
+		if err := printElections(elections, failed > 0, !noHeaders, cmd.OutOrStdout()); err != nil {
+			return err
+		}
+	} else if err := printPrimitives(primitives, !noHeaders, cmd.OutOrStdout()); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to read %d of %d elections", failed, len(elections))
+	}
+	return nil
+}
+
+// readElectionTerms reads the current term of each election in parallel, bounded by the given concurrency,
+// and returns the number of elections that could not be read. Each read is bounded by its own timeout.
+func readElectionTerms(cmd *cobra.Command, database *client.Database, elections []electionInfo, concurrency int) int {
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for i := range elections {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(info *electionInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, cancel := getTimeoutContext(cmd)
+			defer cancel()
+			term, err := readElectionTerm(ctx, database, info.Name)
+			if err != nil {
+				info.Error = err.Error()
+				return
+			}
+			var leader string
+			var candidates int
+			if term != nil {
+				leader = term.Leader
+				candidates = len(term.Candidates)
+			}
+			info.Leader = &leader
+			info.Candidates = &candidates
+		}(&elections[i])
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, info := range elections {
+		if info.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+func readElectionTerm(ctx context.Context, database *client.Database, name string) (*election.Term, error) {
+	e, err := database.GetElection(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close(ctx)
+	return e.GetTerm(ctx)
+}
+
+func printElections(elections []electionInfo, includeErrors bool, includeHeaders bool, out io.Writer) error {
+	headers := []string{"NAME", "SCOPE", "TYPE", "LEADER", "CANDIDATES"}
+	if includeErrors {
+		headers = append(headers, "ERROR")
+	}
+	rows := make([][]string, len(elections))
+	for i, info := range elections {
+		row := []string{info.Name, info.Scope, strcase.ToKebab(string(election.Type)), "", ""}
+		if info.Leader != nil {
+			row[3] = *info.Leader
+		}
+		if info.Candidates != nil {
+			row[4] = strconv.Itoa(*info.Candidates)
+		}
+		if includeErrors {
+			row = append(row, info.Error)
+		}
+		rows[i] = row
+	}
+	return printTable(headers, rows, includeHeaders, out)
+}
+
 func printPrimitives(primitives []primitive.Metadata, includeHeaders bool, out io.Writer) error {
+	rows := make([][]string, len(primitives))
+	for i, primitive := range primitives {
+		rows[i] = []string{primitive.Name.Name, primitive.Name.Scope, strcase.ToKebab(string(primitive.Type))}
+	}
+	return printTable([]string{"NAME", "SCOPE", "TYPE"}, rows, includeHeaders, out)
+}
+
+func printTable(headers []string, rows [][]string, includeHeaders bool, out io.Writer) error {
 	writer := new(tabwriter.Writer)
 	writer.Init(out, 0, 0, 3, ' ', tabwriter.FilterHTML)
 	if includeHeaders {
-		fmt.Fprintln(writer, "NAME\tSCOPE\tTYPE")
+		fmt.Fprintln(writer, strings.Join(headers, "\t"))
 	}
-	for _, primitive := range primitives {
-		fmt.Fprintln(writer, fmt.Sprintf("%s\t%s\t%s", primitive.Name.Name, primitive.Name.Scope, strcase.ToKebab(string(primitive.Type))))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
 	}
 	return writer.Flush()
 }